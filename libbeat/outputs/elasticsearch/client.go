@@ -0,0 +1,104 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+)
+
+// BulkItem pairs a single bulk meta line with its document body, the
+// shape bulkEncodePublishRequest hands to the encoder one event at a time.
+type BulkItem struct {
+	Meta interface{}
+	Obj  interface{}
+}
+
+// Connection holds everything needed to issue a single Elasticsearch
+// HTTP request: the base URL, the HTTP client to send it over, and the
+// bodyEncoder used to marshal the request body.
+type Connection struct {
+	URL     string
+	HTTP    *http.Client
+	encoder bodyEncoder
+}
+
+// request marshals body through conn.encoder and issues method/path
+// against conn.URL, aborting as soon as ctx is done rather than blocking
+// until the whole request completes regardless of a shutdown or
+// per-request deadline.
+func (conn *Connection) request(ctx context.Context, method, path string, body interface{}) (int, []byte, error) {
+	if err := conn.encoder.Marshal(body); err != nil {
+		return 0, nil, err
+	}
+
+	req, err := http.NewRequest(method, conn.URL+path, conn.encoder.Reader())
+	if err != nil {
+		return 0, nil, err
+	}
+	req = req.WithContext(ctx)
+	conn.encoder.AddHeader(&req.Header)
+
+	resp, err := conn.HTTP.Do(req)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, data, err
+}
+
+// bulkEncodePublishRequestCtx behaves like bulkEncodePublishRequest, but
+// encodes via AddCtx so a shutdown or deadline expiry partway through a
+// large batch aborts the encode immediately (and reclaims enc's buffer)
+// instead of running the whole batch to completion first.
+func bulkEncodePublishRequestCtx(ctx context.Context, enc bodyEncoder, items []BulkItem) ([]byte, error) {
+	enc.Reset()
+
+	for _, item := range items {
+		if err := enc.AddCtx(ctx, item.Meta, item.Obj); err != nil {
+			return nil, err
+		}
+	}
+
+	return readAll(enc)
+}
+
+// bulkEncodePublishRequest fills enc with as many leading items as fit
+// within its configured MaxBytes (via TryAdd), returning the encoded
+// body for this request and the remaining items that did not fit so the
+// caller can flush, reset, and retry them in the next request instead of
+// producing a body Elasticsearch would reject outright for exceeding
+// http.max_content_length.
+func bulkEncodePublishRequest(enc bodyEncoder, items []BulkItem) (body []byte, remaining []BulkItem, err error) {
+	enc.Reset()
+
+	for i, item := range items {
+		added, err := enc.TryAdd(item.Meta, item.Obj)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !added {
+			body, err := readAll(enc)
+			if err != nil {
+				return nil, nil, err
+			}
+			return body, items[i:], nil
+		}
+	}
+
+	body, err = readAll(enc)
+	if err != nil {
+		return nil, nil, err
+	}
+	return body, nil, nil
+}
+
+func readAll(enc bodyEncoder) ([]byte, error) {
+	var buf bytes.Buffer
+	if _, err := buf.ReadFrom(enc.Reader()); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,91 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"fmt"
+)
+
+// Config holds the body-encoding related settings for the Elasticsearch
+// output: the wire format, how (and whether) to compress the bulk body,
+// and at what size compression starts paying for itself.
+type Config struct {
+	// Format selects the bulk body encoding: "json" (the default) or
+	// "cbor". Ignored for the direct/passthrough encoder.
+	//
+	// "smile" was dropped: the encoder never implemented the real
+	// Jackson Smile wire format (it used fixed-width big-endian ints
+	// instead of zigzag VInts and an invented string length prefix
+	// instead of the real short/long string tokens), so anything
+	// written with it would not parse as Smile on the Elasticsearch
+	// side. Re-add it only once it's been verified against a real ES
+	// node.
+	Format string `config:"format"`
+
+	// CompressionLevel is the gzip level used when CompressionThresholdBytes
+	// is 0 (the all-or-nothing encoder); ignored once a threshold is set,
+	// and ignored outside of Format "json".
+	CompressionLevel int `config:"compression_level"`
+
+	// CompressionThresholdBytes switches the output to the adaptive
+	// encoder: bulk bodies below this size are sent uncompressed, bodies
+	// at or above it are gzipped. 0 disables adaptive compression.
+	// Only applies to Format "json".
+	CompressionThresholdBytes int `config:"compression_threshold_bytes"`
+
+	// BulkMaxBytes caps the encoded size of a single bulk request body,
+	// so bulkEncodePublishRequest can split a batch across requests instead of
+	// producing a body Elasticsearch will reject for exceeding
+	// http.max_content_length. 0 leaves the body size unbounded. Ignored
+	// for encoders that don't implement TryAdd's size cap (cbor).
+	BulkMaxBytes int `config:"bulk_max_bytes"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		Format:                    "json",
+		CompressionLevel:          0,
+		CompressionThresholdBytes: 0,
+		BulkMaxBytes:              0,
+	}
+}
+
+// maxBytesSetter is implemented by the encoders whose TryAdd honors a
+// size cap (jsonEncoder, gzipEncoder, and adaptiveEncoder through its
+// embedded jsonEncoder, measured on the uncompressed buffer); cborEncoder
+// doesn't implement it and is left unbounded.
+type maxBytesSetter interface {
+	SetMaxBytes(n int)
+}
+
+// newBodyEncoder builds the bodyEncoder this output's config calls for,
+// reusing buf across requests the same way the individual encoder
+// constructors do.
+func newBodyEncoder(config Config, buf *bytes.Buffer) (bodyEncoder, error) {
+	enc, err := newBodyEncoderFormat(config, buf)
+	if err != nil {
+		return nil, err
+	}
+	if config.BulkMaxBytes > 0 {
+		if s, ok := enc.(maxBytesSetter); ok {
+			s.SetMaxBytes(config.BulkMaxBytes)
+		}
+	}
+	return enc, nil
+}
+
+func newBodyEncoderFormat(config Config, buf *bytes.Buffer) (bodyEncoder, error) {
+	switch config.Format {
+	case "", "json":
+		if config.CompressionThresholdBytes > 0 {
+			return newAdaptiveEncoder(config.CompressionThresholdBytes, buf), nil
+		}
+		if config.CompressionLevel > 0 {
+			return newGzipEncoder(config.CompressionLevel, buf)
+		}
+		return newJSONEncoder(buf), nil
+	case "cbor":
+		return newCBOREncoder(buf), nil
+	default:
+		return nil, fmt.Errorf("elasticsearch output: unknown format %q", config.Format)
+	}
+}
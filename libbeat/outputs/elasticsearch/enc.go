@@ -3,14 +3,55 @@ package elasticsearch
 import (
 	"bytes"
 	"compress/gzip"
+	"context"
 	"encoding/json"
 	"errors"
 	"io"
 	"net/http"
+	"sync"
 
 	"github.com/elastic/beats/libbeat/common"
+	"github.com/ugorji/go/codec"
 )
 
+// ctxCheckInterval is how many records an encoder buffers between checks
+// of the caller's context, so cancellation is noticed promptly without
+// paying a select on every single record in a large batch.
+const ctxCheckInterval = 256
+
+// checkCtx increments *n and, every ctxCheckInterval records, does a
+// non-blocking check of ctx for cancellation/deadline expiry. It mirrors
+// the cancel-channel pattern used elsewhere in the codebase for deadline
+// handling: cheap to poll, and never blocks the encoding goroutine.
+func checkCtx(ctx context.Context, n *int) error {
+	*n++
+	if *n%ctxCheckInterval != 0 {
+		return nil
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	default:
+		return nil
+	}
+}
+
+// defaultCompressionThreshold is the minimum uncompressed bulk body size
+// (in bytes) that adaptiveEncoder will bother gzip-compressing. Below this
+// the CPU cost of compression outweighs the bandwidth it saves, so the
+// plain JSON body is sent as-is.
+const defaultCompressionThreshold = 128 * 1024
+
+// gzipWriterPool recycles *gzip.Writer instances across adaptiveEncoder
+// requests so encoding a bulk body above the compression threshold does
+// not allocate a fresh compressor (and its internal tables) every time.
+var gzipWriterPool = sync.Pool{
+	New: func() interface{} {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	},
+}
+
 type bodyEncoder interface {
 	bulkBodyEncoder
 	Reader() io.Reader
@@ -27,22 +68,59 @@ type bulkBodyEncoder interface {
 type bulkWriter interface {
 	Add(meta, obj interface{}) error
 	AddRaw(raw interface{}) error
+
+	// TryAdd behaves like Add, but refuses to add the record (returning
+	// added=false, err=nil) if doing so would push the encoded body past
+	// the encoder's configured MaxBytes. A MaxBytes of 0 means unbounded,
+	// in which case TryAdd always adds.
+	TryAdd(meta, obj interface{}) (added bool, err error)
+
+	// AddCtx behaves like Add, but periodically checks ctx and aborts
+	// with ctx.Err() once it is done, instead of running an entire large
+	// batch to completion regardless of a shutdown or request deadline.
+	AddCtx(ctx context.Context, meta, obj interface{}) error
 }
 
 type jsonEncoder struct {
-	buf *bytes.Buffer
+	buf       *bytes.Buffer
+	maxBytes  int
+	ctxChecks int
+}
+
+// countingWriter forwards writes to w while accumulating the number of
+// uncompressed bytes seen, so callers that only have access to the
+// compressed output (e.g. gzipEncoder) can still measure the body size
+// Elasticsearch will actually have to parse after decompression.
+type countingWriter struct {
+	n int64
+	w io.Writer
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
 }
 
 type gzipEncoder struct {
-	buf  *bytes.Buffer
-	gzip *gzip.Writer
+	buf       *bytes.Buffer
+	gzip      *gzip.Writer
+	counter   *countingWriter
+	maxBytes  int
+	ctxChecks int
 }
 
 func newJSONEncoder(buf *bytes.Buffer) *jsonEncoder {
 	if buf == nil {
 		buf = bytes.NewBuffer(nil)
 	}
-	return &jsonEncoder{buf}
+	return &jsonEncoder{buf: buf}
+}
+
+// SetMaxBytes caps the encoded body at n bytes; TryAdd refuses records
+// that would push the buffer past it. n <= 0 means unbounded.
+func (b *jsonEncoder) SetMaxBytes(n int) {
+	b.maxBytes = n
 }
 
 func (b *jsonEncoder) Reset() {
@@ -83,6 +161,45 @@ func (b *jsonEncoder) Add(meta, obj interface{}) error {
 	return nil
 }
 
+// TryAdd refuses to add (meta, obj) if doing so would grow the body past
+// maxBytes, so a caller that hits a full batch can flush the current
+// buffer and retry the record in the next request instead of producing a
+// bulk body Elasticsearch will reject outright for exceeding
+// http.max_content_length.
+//
+// A record is always added to an empty buffer, even if its own encoded
+// size already exceeds maxBytes: refusing it here would leave the caller
+// retrying the same oversized record against an empty buffer forever.
+// Such a record still goes out alone, oversized, rather than looping.
+func (b *jsonEncoder) TryAdd(meta, obj interface{}) (bool, error) {
+	if b.maxBytes <= 0 || b.buf.Len() == 0 {
+		return true, b.Add(meta, obj)
+	}
+
+	var scratch bytes.Buffer
+	enc := json.NewEncoder(&scratch)
+	if err := enc.Encode(meta); err != nil {
+		return false, err
+	}
+	if err := enc.Encode(obj); err != nil {
+		return false, err
+	}
+
+	if b.buf.Len()+scratch.Len() > b.maxBytes {
+		return false, nil
+	}
+	b.buf.Write(scratch.Bytes())
+	return true, nil
+}
+
+func (b *jsonEncoder) AddCtx(ctx context.Context, meta, obj interface{}) error {
+	if err := checkCtx(ctx, &b.ctxChecks); err != nil {
+		b.Reset()
+		return err
+	}
+	return b.Add(meta, obj)
+}
+
 func newGzipEncoder(level int, buf *bytes.Buffer) (*gzipEncoder, error) {
 	if buf == nil {
 		buf = bytes.NewBuffer(nil)
@@ -92,12 +209,19 @@ func newGzipEncoder(level int, buf *bytes.Buffer) (*gzipEncoder, error) {
 		return nil, err
 	}
 
-	return &gzipEncoder{buf, w}, nil
+	return &gzipEncoder{buf: buf, gzip: w, counter: &countingWriter{w: w}}, nil
+}
+
+// SetMaxBytes caps the uncompressed body at n bytes; TryAdd refuses
+// records that would push it past that. n <= 0 means unbounded.
+func (b *gzipEncoder) SetMaxBytes(n int) {
+	b.maxBytes = n
 }
 
 func (b *gzipEncoder) Reset() {
 	b.buf.Reset()
 	b.gzip.Reset(b.buf)
+	b.counter.n = 0
 }
 
 func (b *gzipEncoder) Reader() io.Reader {
@@ -112,18 +236,18 @@ func (b *gzipEncoder) AddHeader(header *http.Header) {
 
 func (b *gzipEncoder) Marshal(obj interface{}) error {
 	b.Reset()
-	enc := json.NewEncoder(b.gzip)
+	enc := json.NewEncoder(b.counter)
 	err := enc.Encode(obj)
 	return err
 }
 
 func (b *gzipEncoder) AddRaw(raw interface{}) error {
-	enc := json.NewEncoder(b.gzip)
+	enc := json.NewEncoder(b.counter)
 	return enc.Encode(raw)
 }
 
 func (b *gzipEncoder) Add(meta, obj interface{}) error {
-	enc := json.NewEncoder(b.gzip)
+	enc := json.NewEncoder(b.counter)
 	pos := b.buf.Len()
 
 	if err := enc.Encode(meta); err != nil {
@@ -139,6 +263,170 @@ func (b *gzipEncoder) Add(meta, obj interface{}) error {
 	return nil
 }
 
+// TryAdd mirrors jsonEncoder.TryAdd, but compares against the
+// uncompressed byte count tracked by counter rather than the (much
+// smaller) compressed buffer length, since that uncompressed count is
+// what Elasticsearch's http.max_content_length actually bounds once the
+// request body is decompressed.
+//
+// As with jsonEncoder.TryAdd, a record is always added when the encoder
+// is still empty (counter.n == 0), even if its own encoded size already
+// exceeds maxBytes, so a single oversized document goes out alone rather
+// than being refused forever by a caller that flushes and retries it.
+func (b *gzipEncoder) TryAdd(meta, obj interface{}) (bool, error) {
+	if b.maxBytes <= 0 || b.counter.n == 0 {
+		return true, b.Add(meta, obj)
+	}
+
+	var scratch bytes.Buffer
+	enc := json.NewEncoder(&scratch)
+	if err := enc.Encode(meta); err != nil {
+		return false, err
+	}
+	if err := enc.Encode(obj); err != nil {
+		return false, err
+	}
+
+	if int(b.counter.n)+scratch.Len() > b.maxBytes {
+		return false, nil
+	}
+	return true, b.Add(meta, obj)
+}
+
+// AddCtx reclaims the gzip writer's buffer via Reset on cancellation so a
+// shutdown or deadline expiry mid-batch does not leave a large partially
+// compressed body sitting in memory.
+func (b *gzipEncoder) AddCtx(ctx context.Context, meta, obj interface{}) error {
+	if err := checkCtx(ctx, &b.ctxChecks); err != nil {
+		b.Reset()
+		return err
+	}
+	return b.Add(meta, obj)
+}
+
+// adaptiveEncoder buffers the bulk body as plain JSON and only pays the
+// cost of gzip compression when the accumulated body grows past
+// threshold bytes, so small requests (e.g. heartbeat pings) skip
+// compression entirely while large batches still get it.
+type adaptiveEncoder struct {
+	jsonEncoder
+	threshold int
+}
+
+func newAdaptiveEncoder(threshold int, buf *bytes.Buffer) *adaptiveEncoder {
+	if buf == nil {
+		buf = bytes.NewBuffer(nil)
+	}
+	if threshold <= 0 {
+		threshold = defaultCompressionThreshold
+	}
+	return &adaptiveEncoder{jsonEncoder{buf: buf}, threshold}
+}
+
+func (b *adaptiveEncoder) compress() bool {
+	return b.buf.Len() >= b.threshold
+}
+
+func (b *adaptiveEncoder) AddHeader(header *http.Header) {
+	if b.compress() {
+		header.Add("Content-Type", "application/json; charset=UTF-8")
+		header.Add("Content-Encoding", "gzip")
+	} else {
+		header.Add("Content-Type", "application/json; charset=UTF-8")
+	}
+}
+
+// Reader returns the raw buffer when it is below the compression
+// threshold, otherwise it streams the buffered body through a pooled
+// gzip.Writer so encoding large batches does not allocate a fresh
+// compressor per request.
+func (b *adaptiveEncoder) Reader() io.Reader {
+	if !b.compress() {
+		return b.buf
+	}
+
+	gz := gzipWriterPool.Get().(*gzip.Writer)
+	defer gzipWriterPool.Put(gz)
+
+	compressed := bytes.NewBuffer(nil)
+	gz.Reset(compressed)
+
+	if _, err := gz.Write(b.buf.Bytes()); err != nil {
+		return b.buf
+	}
+	if err := gz.Close(); err != nil {
+		return b.buf
+	}
+	return compressed
+}
+
+// cborHandle is shared across all cborEncoder instances; codec.Handle
+// values are safe for concurrent use once configured and are meant to be
+// reused rather than allocated per encoder.
+var cborHandle = &codec.CborHandle{}
+
+type cborEncoder struct {
+	buf       *bytes.Buffer
+	enc       *codec.Encoder
+	ctxChecks int
+}
+
+func newCBOREncoder(buf *bytes.Buffer) *cborEncoder {
+	if buf == nil {
+		buf = bytes.NewBuffer(nil)
+	}
+	return &cborEncoder{buf: buf, enc: codec.NewEncoder(buf, cborHandle)}
+}
+
+func (b *cborEncoder) Reset() {
+	b.buf.Reset()
+	b.enc.Reset(b.buf)
+}
+
+func (b *cborEncoder) AddHeader(header *http.Header) {
+	header.Add("Content-Type", "application/cbor")
+}
+
+func (b *cborEncoder) Reader() io.Reader {
+	return b.buf
+}
+
+func (b *cborEncoder) Marshal(obj interface{}) error {
+	b.Reset()
+	return b.enc.Encode(obj)
+}
+
+func (b *cborEncoder) AddRaw(raw interface{}) error {
+	return b.enc.Encode(raw)
+}
+
+func (b *cborEncoder) Add(meta, obj interface{}) error {
+	pos := b.buf.Len()
+
+	if err := b.enc.Encode(meta); err != nil {
+		b.buf.Truncate(pos)
+		return err
+	}
+	if err := b.enc.Encode(obj); err != nil {
+		b.buf.Truncate(pos)
+		return err
+	}
+	return nil
+}
+
+// TryAdd always adds; cborEncoder does not support a MaxBytes cap.
+func (b *cborEncoder) TryAdd(meta, obj interface{}) (bool, error) {
+	return true, b.Add(meta, obj)
+}
+
+func (b *cborEncoder) AddCtx(ctx context.Context, meta, obj interface{}) error {
+	if err := checkCtx(ctx, &b.ctxChecks); err != nil {
+		b.Reset()
+		return err
+	}
+	return b.Add(meta, obj)
+}
+
 type directJsonEncoder struct {
 	jsonEncoder
 }
@@ -152,17 +440,67 @@ func newDirectJSONEncoder(buf *bytes.Buffer) *directJsonEncoder {
 	return &encoder //directJsonEncoder{jsonEncoder{buf}}
 }
 
-func isDirectFlagSet(obj interface{}) (bool, interface{}) {
-	if amap, ok := obj.(common.MapStr); ok {
-		_, direct := amap["send_direct_flag"]
-		if direct {
-			return direct, amap["message"]
-		} else {
-			return false, nil
+// passthroughDetector is the shape registered detectors must implement:
+// given an object handed to Add/Marshal, report whether it is already
+// serialized and, if so, the raw bytes to write as-is instead of
+// round-tripping it through encoding/json.
+type passthroughDetector func(obj interface{}) (raw []byte, ok bool)
+
+var (
+	// passthroughMu guards passthroughDetectors. Writers (RegisterPassthrough)
+	// only ever run during Beat startup; readers (detectPassthrough) run on
+	// every Add/Marshal call in the hot publish path, so an RWMutex lets
+	// those readers proceed concurrently instead of serializing on a
+	// single lock across every output worker.
+	passthroughMu        sync.RWMutex
+	passthroughDetectors = map[string]passthroughDetector{}
+)
+
+// RegisterPassthrough registers a detector under name so directJsonEncoder
+// can recognize pre-serialized input from other input types (e.g. a raw
+// NDJSON harvester) and skip the JSON round-trip for it, the same way it
+// already does for send_direct_flag. Safe to call concurrently, but is
+// only meant to be used during Beat startup, before any encoding happens.
+func RegisterPassthrough(name string, detect func(interface{}) ([]byte, bool)) {
+	passthroughMu.Lock()
+	defer passthroughMu.Unlock()
+	passthroughDetectors[name] = detect
+}
+
+// detectSendDirectFlag is the original convention directJsonEncoder
+// supported: a common.MapStr with a "send_direct_flag" key and a
+// "message" string to send as-is. Unlike the generic passthroughDetector
+// shape, it reports an error when the flag is present but "message" is
+// missing/not a string, rather than silently falling through to encoding
+// the sentinel object (including its internal "send_direct_flag" key) as
+// a normal document.
+func detectSendDirectFlag(obj interface{}) (raw []byte, matched bool, err error) {
+	amap, ok := obj.(common.MapStr)
+	if !ok {
+		return nil, false, nil
+	}
+	if _, direct := amap["send_direct_flag"]; !direct {
+		return nil, false, nil
+	}
+	message, ok := amap["message"].(string)
+	if !ok {
+		return nil, true, errors.New("no 'message' field in object")
+	}
+	return []byte(message), true, nil
+}
+
+// detectPassthrough runs obj through the registered detectors and returns
+// the raw bytes from the first one that recognizes it. Detectors are kept
+// in a map, so the order in which they are tried is not defined.
+func detectPassthrough(obj interface{}) ([]byte, bool) {
+	passthroughMu.RLock()
+	defer passthroughMu.RUnlock()
+	for _, detect := range passthroughDetectors {
+		if raw, ok := detect(obj); ok {
+			return raw, true
 		}
-	} else {
-		return false, nil
 	}
+	return nil, false
 }
 
 // used by bulkEncodePublishRequest
@@ -175,17 +513,19 @@ func (b *directJsonEncoder) Add(meta, obj interface{}) error {
 		return err
 	}
 
-	//if obj is map and have flag send_direct then send message field directly
-	//otherwise fallback to jsonEncoder's Add
-	direct, message := isDirectFlagSet(obj)
-	if direct {
-		if message != nil {
-			b.buf.WriteString(message.(string))
-			b.buf.WriteByte('\n')
-		} else {
+	//send_direct_flag keeps its original, error-surfacing behavior; any
+	//other registered passthrough detector just writes its raw bytes;
+	//otherwise fall back to jsonEncoder's Add
+	if raw, matched, err := detectSendDirectFlag(obj); matched {
+		if err != nil {
 			b.buf.Truncate(pos)
-			return errors.New("no 'message' field in object")
+			return err
 		}
+		b.buf.Write(raw)
+		b.buf.WriteByte('\n')
+	} else if raw, ok := detectPassthrough(obj); ok {
+		b.buf.Write(raw)
+		b.buf.WriteByte('\n')
 	} else {
 		if err := enc.Encode(obj); err != nil {
 			b.buf.Truncate(pos)
@@ -200,17 +540,57 @@ func (b *directJsonEncoder) Add(meta, obj interface{}) error {
 func (b *directJsonEncoder) Marshal(obj interface{}) error {
 	b.Reset()
 
-	direct, message := isDirectFlagSet(obj)
-	if direct {
-		if message != nil {
-			b.buf.WriteString(message.(string))
-			b.buf.WriteByte('\n')
-			return nil
-		} else {
-			return errors.New("no 'message' field in object")
+	if raw, matched, err := detectSendDirectFlag(obj); matched {
+		if err != nil {
+			return err
 		}
-	} else {
-		enc := json.NewEncoder(b.buf)
-		return enc.Encode(obj)
+		b.buf.Write(raw)
+		b.buf.WriteByte('\n')
+		return nil
+	}
+
+	if raw, ok := detectPassthrough(obj); ok {
+		b.buf.Write(raw)
+		b.buf.WriteByte('\n')
+		return nil
+	}
+
+	enc := json.NewEncoder(b.buf)
+	return enc.Encode(obj)
+}
+
+// TryAdd and AddCtx must be overridden here rather than left promoted
+// from the embedded jsonEncoder: a promoted method's receiver is the
+// embedded jsonEncoder, so its own b.Add call would bypass this type's
+// Add above and lose the passthrough/send_direct_flag handling (and the
+// "no message field" error) for any record driven through the generic
+// bulkWriter interface.
+
+// TryAdd behaves like jsonEncoder.TryAdd, but measures the record by
+// writing it through directJsonEncoder's own Add and rolling back if
+// that pushes the buffer past maxBytes, since a passthrough record's
+// encoded size can't be known ahead of writing it the way a plain JSON
+// record can be pre-encoded into a scratch buffer.
+func (b *directJsonEncoder) TryAdd(meta, obj interface{}) (bool, error) {
+	if b.maxBytes <= 0 || b.buf.Len() == 0 {
+		return true, b.Add(meta, obj)
+	}
+
+	pos := b.buf.Len()
+	if err := b.Add(meta, obj); err != nil {
+		return false, err
+	}
+	if b.buf.Len() > b.maxBytes {
+		b.buf.Truncate(pos)
+		return false, nil
+	}
+	return true, nil
+}
+
+func (b *directJsonEncoder) AddCtx(ctx context.Context, meta, obj interface{}) error {
+	if err := checkCtx(ctx, &b.ctxChecks); err != nil {
+		b.Reset()
+		return err
 	}
+	return b.Add(meta, obj)
 }
@@ -0,0 +1,414 @@
+package elasticsearch
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/elastic/beats/libbeat/common"
+	"github.com/ugorji/go/codec"
+)
+
+func TestAdaptiveEncoderBelowThreshold(t *testing.T) {
+	enc := newAdaptiveEncoder(1024, nil)
+	if err := enc.Add(map[string]interface{}{"index": map[string]interface{}{}}, map[string]interface{}{"a": "b"}); err != nil {
+		t.Fatal(err)
+	}
+
+	header := http.Header{}
+	enc.AddHeader(&header)
+	if header.Get("Content-Encoding") != "" {
+		t.Fatalf("expected no Content-Encoding below threshold, got %q", header.Get("Content-Encoding"))
+	}
+
+	data, err := ioutil.ReadAll(enc.Reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte(`"a":"b"`)) {
+		t.Fatalf("expected plain JSON body, got %q", data)
+	}
+}
+
+func TestAdaptiveEncoderAboveThreshold(t *testing.T) {
+	enc := newAdaptiveEncoder(16, nil)
+	if err := enc.Add(map[string]interface{}{"index": map[string]interface{}{}}, map[string]interface{}{"message": "this document is well over the tiny threshold"}); err != nil {
+		t.Fatal(err)
+	}
+
+	header := http.Header{}
+	enc.AddHeader(&header)
+	if header.Get("Content-Encoding") != "gzip" {
+		t.Fatalf("expected gzip Content-Encoding above threshold, got %q", header.Get("Content-Encoding"))
+	}
+
+	r, err := gzip.NewReader(enc.Reader())
+	if err != nil {
+		t.Fatalf("response body is not valid gzip: %v", err)
+	}
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(data, []byte("well over the tiny threshold")) {
+		t.Fatalf("decompressed body missing original content, got %q", data)
+	}
+}
+
+func TestCBOREncoderRoundTrip(t *testing.T) {
+	enc, err := newBodyEncoder(Config{Format: "cbor"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := enc.(*cborEncoder); !ok {
+		t.Fatalf("expected *cborEncoder for Format cbor, got %T", enc)
+	}
+
+	meta := common.MapStr{"index": common.MapStr{"_index": "metricbeat"}}
+	doc := common.MapStr{"message": "hello"}
+	if err := enc.Add(meta, doc); err != nil {
+		t.Fatal(err)
+	}
+
+	header := http.Header{}
+	enc.AddHeader(&header)
+	if header.Get("Content-Type") != "application/cbor" {
+		t.Fatalf("unexpected Content-Type %q", header.Get("Content-Type"))
+	}
+
+	data, err := ioutil.ReadAll(enc.Reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dec := codec.NewDecoderBytes(data, cborHandle)
+	var gotMeta, gotDoc map[string]interface{}
+	if err := dec.Decode(&gotMeta); err != nil {
+		t.Fatalf("meta record did not decode as valid CBOR: %v", err)
+	}
+	if err := dec.Decode(&gotDoc); err != nil {
+		t.Fatalf("doc record did not decode as valid CBOR: %v", err)
+	}
+	if gotDoc["message"] != "hello" {
+		t.Fatalf("round-tripped doc missing field, got %v", gotDoc)
+	}
+}
+
+func TestNewBodyEncoderUnknownFormat(t *testing.T) {
+	if _, err := newBodyEncoder(Config{Format: "bson"}, nil); err == nil {
+		t.Fatal("expected an error for an unknown format")
+	}
+}
+
+// TestNewBodyEncoderSmileDropped guards against Format "smile" silently
+// reappearing: the encoder was removed because it didn't implement the
+// real Jackson Smile wire format, so it must stay rejected like any
+// other unknown format until a spec-conformant version replaces it.
+func TestNewBodyEncoderSmileDropped(t *testing.T) {
+	if _, err := newBodyEncoder(Config{Format: "smile"}, nil); err == nil {
+		t.Fatal("expected Format smile to be rejected")
+	}
+}
+
+func TestNewBodyEncoderWiresBulkMaxBytes(t *testing.T) {
+	enc, err := newBodyEncoder(Config{Format: "json", BulkMaxBytes: 64}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jsonEnc, ok := enc.(*jsonEncoder)
+	if !ok {
+		t.Fatalf("expected *jsonEncoder for Format json, got %T", enc)
+	}
+	if jsonEnc.maxBytes != 64 {
+		t.Fatalf("expected BulkMaxBytes to be wired into maxBytes, got %d", jsonEnc.maxBytes)
+	}
+}
+
+func TestBulkEncodePublishRequestSplitsOversizedBatch(t *testing.T) {
+	enc := newJSONEncoder(nil)
+	enc.SetMaxBytes(64)
+
+	items := []BulkItem{
+		{Meta: common.MapStr{"index": common.MapStr{}}, Obj: common.MapStr{"seq": 1}},
+		{Meta: common.MapStr{"index": common.MapStr{}}, Obj: common.MapStr{"seq": 2}},
+		{Meta: common.MapStr{"index": common.MapStr{}}, Obj: common.MapStr{"seq": 3}},
+	}
+
+	body, remaining, err := bulkEncodePublishRequest(enc, items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) == 0 {
+		t.Fatal("expected the oversized batch to be split, got no remaining items")
+	}
+	if !bytes.Contains(body, []byte(`"seq":1`)) {
+		t.Fatalf("first request should contain the first item in order, got %q", body)
+	}
+
+	// The rejected item must be retried, in order, in the next request.
+	body2, remaining2, err := bulkEncodePublishRequest(enc, remaining)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining2) != 0 {
+		t.Fatalf("expected the retry request to fit the rest, got %d left over", len(remaining2))
+	}
+	if !bytes.Contains(body2, []byte(`"seq":3`)) {
+		t.Fatalf("retry request should contain the next item in order, got %q", body2)
+	}
+}
+
+// TestBulkEncodePublishRequestSingleOversizedDocument covers the forward
+// progress guarantee on TryAdd: a document whose own encoded size is
+// already over MaxBytes must still go out, alone, rather than being
+// rejected against an empty buffer and handed back to the caller to
+// retry forever.
+func TestBulkEncodePublishRequestSingleOversizedDocument(t *testing.T) {
+	enc := newJSONEncoder(nil)
+	enc.SetMaxBytes(64)
+
+	huge := make([]byte, 256)
+	for i := range huge {
+		huge[i] = 'x'
+	}
+
+	items := []BulkItem{
+		{Meta: common.MapStr{"index": common.MapStr{}}, Obj: common.MapStr{"message": string(huge)}},
+		{Meta: common.MapStr{"index": common.MapStr{}}, Obj: common.MapStr{"seq": 2}},
+	}
+
+	body, remaining, err := bulkEncodePublishRequest(enc, items)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(body, huge) {
+		t.Fatalf("expected the oversized document to be encoded alone, got %q", body)
+	}
+	if len(remaining) != 1 {
+		t.Fatalf("expected only the second item left over, got %d", len(remaining))
+	}
+
+	body2, remaining2, err := bulkEncodePublishRequest(enc, remaining)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining2) != 0 {
+		t.Fatalf("expected the retry request to fit the rest, got %d left over", len(remaining2))
+	}
+	if !bytes.Contains(body2, []byte(`"seq":2`)) {
+		t.Fatalf("retry request should contain the next item, got %q", body2)
+	}
+}
+
+// TestGzipEncoderTryAddSplitsOnUncompressedSize checks that TryAdd caps
+// the body against the uncompressed byte count (what Elasticsearch's
+// http.max_content_length actually bounds after decompression), not the
+// much smaller compressed buffer length.
+func TestGzipEncoderTryAddSplitsOnUncompressedSize(t *testing.T) {
+	enc, err := newGzipEncoder(gzip.BestSpeed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.SetMaxBytes(64)
+
+	meta := common.MapStr{"index": common.MapStr{}}
+	added, err := enc.TryAdd(meta, common.MapStr{"seq": 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !added {
+		t.Fatal("expected the first small record to be added")
+	}
+
+	var rejected bool
+	for i := 2; i < 100 && !rejected; i++ {
+		added, err := enc.TryAdd(meta, common.MapStr{"seq": i})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !added {
+			rejected = true
+		}
+	}
+	if !rejected {
+		t.Fatal("expected TryAdd to eventually refuse a record once the uncompressed count exceeds maxBytes")
+	}
+}
+
+// TestGzipEncoderTryAddSingleOversizedDocument mirrors
+// TestBulkEncodePublishRequestSingleOversizedDocument for gzip: a record
+// whose own uncompressed size already exceeds maxBytes must still be
+// added to an empty encoder instead of being refused forever.
+func TestGzipEncoderTryAddSingleOversizedDocument(t *testing.T) {
+	enc, err := newGzipEncoder(gzip.BestSpeed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc.SetMaxBytes(64)
+
+	huge := make([]byte, 256)
+	for i := range huge {
+		huge[i] = 'x'
+	}
+
+	added, err := enc.TryAdd(common.MapStr{"index": common.MapStr{}}, common.MapStr{"message": string(huge)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !added {
+		t.Fatal("expected the oversized record to be added to an empty encoder")
+	}
+}
+
+// TestGzipEncoderAddCtxAbortsOnCancel mirrors
+// TestBulkEncodePublishRequestCtxAbortsOnCancel for gzip, checking that
+// AddCtx reclaims the gzip writer's buffer via Reset on cancellation.
+func TestGzipEncoderAddCtxAbortsOnCancel(t *testing.T) {
+	enc, err := newGzipEncoder(gzip.BestSpeed, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	meta := common.MapStr{"index": common.MapStr{}}
+	for i := 0; i < ctxCheckInterval*3; i++ {
+		if err := enc.AddCtx(ctx, meta, common.MapStr{"seq": i}); err == context.Canceled {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	data, err := ioutil.ReadAll(enc.Reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatalf("response body is not valid gzip after cancellation: %v", err)
+	}
+	decompressed, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(decompressed) != 0 {
+		t.Fatalf("expected the buffer to be reclaimed on cancellation, got %d bytes", len(decompressed))
+	}
+}
+
+func TestBulkEncodePublishRequestCtxAbortsOnCancel(t *testing.T) {
+	enc := newJSONEncoder(nil)
+
+	items := make([]BulkItem, ctxCheckInterval*3)
+	for i := range items {
+		items[i] = BulkItem{Meta: common.MapStr{"index": common.MapStr{}}, Obj: common.MapStr{"seq": i}}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := bulkEncodePublishRequestCtx(ctx, enc, items)
+	if err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	data, err := ioutil.ReadAll(enc.Reader())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) != 0 {
+		t.Fatalf("expected the buffer to be reclaimed on cancellation, got %d bytes", len(data))
+	}
+}
+
+// TestDirectJSONEncoderTryAddSurfacesPassthroughError guards against the
+// promoted-method trap: if TryAdd/AddCtx were left to fall through to
+// the embedded jsonEncoder, their b.Add call would bypass
+// directJsonEncoder's own Add and silently run the plain JSON path
+// instead of surfacing the "no message field" passthrough error.
+func TestDirectJSONEncoderTryAddSurfacesPassthroughError(t *testing.T) {
+	meta := common.MapStr{"index": common.MapStr{}}
+	obj := common.MapStr{"send_direct_flag": true}
+	enc := newDirectJSONEncoder(nil)
+
+	if _, err := enc.TryAdd(meta, obj); err == nil {
+		t.Fatal("expected TryAdd to surface the missing-message error")
+	}
+	if err := enc.AddCtx(context.Background(), meta, obj); err == nil {
+		t.Fatal("expected AddCtx to surface the missing-message error")
+	}
+}
+
+// TestDirectJSONEncoderTryAddRespectsMaxBytes checks that TryAdd's size
+// cap is enforced against the passthrough-written bytes, not silently
+// ignored by the promoted jsonEncoder method.
+func TestDirectJSONEncoderTryAddRespectsMaxBytes(t *testing.T) {
+	enc := newDirectJSONEncoder(nil)
+	enc.SetMaxBytes(64)
+
+	meta := common.MapStr{"index": common.MapStr{}}
+	huge := make([]byte, 256)
+	for i := range huge {
+		huge[i] = 'x'
+	}
+	obj := common.MapStr{"send_direct_flag": true, "message": string(huge)}
+
+	added, err := enc.TryAdd(meta, obj)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !added {
+		t.Fatal("expected the oversized record to still be added to an empty buffer")
+	}
+
+	added2, err := enc.TryAdd(meta, common.MapStr{"send_direct_flag": true, "message": "short"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if added2 {
+		t.Fatal("expected a second record to be refused once maxBytes is exceeded")
+	}
+}
+
+// BenchmarkDirectJSONEncoderAddPassthrough measures the send_direct_flag
+// passthrough path: the raw message bytes are written directly, with no
+// JSON round-trip of the document body.
+func BenchmarkDirectJSONEncoderAddPassthrough(b *testing.B) {
+	meta := common.MapStr{"index": common.MapStr{}}
+	obj := common.MapStr{"send_direct_flag": true, "message": `{"field":"value"}`}
+	buf := new(bytes.Buffer)
+	enc := newDirectJSONEncoder(buf)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := enc.Add(meta, obj); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkDirectJSONEncoderAddJSONFallback measures the same call
+// shape for a document that does not match any passthrough detector, so
+// it falls back to a full encoding/json round trip of the body. The
+// delta between this and BenchmarkDirectJSONEncoderAddPassthrough is the
+// allocation cost the passthrough path avoids on the hot path.
+func BenchmarkDirectJSONEncoderAddJSONFallback(b *testing.B) {
+	meta := common.MapStr{"index": common.MapStr{}}
+	obj := common.MapStr{"field": "value"}
+	buf := new(bytes.Buffer)
+	enc := newDirectJSONEncoder(buf)
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		if err := enc.Add(meta, obj); err != nil {
+			b.Fatal(err)
+		}
+	}
+}